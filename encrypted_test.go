@@ -0,0 +1,92 @@
+package storagetests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/anothermemory/storage"
+	"github.com/anothermemory/unit"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticKeyProvider is a storage.KeyProvider backed by an in-memory key set,
+// letting tests exercise key rotation without a real KMS.
+type staticKeyProvider struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+func newStaticKeyProvider(id string, key []byte) *staticKeyProvider {
+	return &staticKeyProvider{activeID: id, keys: map[string][]byte{id: key}}
+}
+
+func (p *staticKeyProvider) ActiveKeyID() string { return p.activeID }
+
+func (p *staticKeyProvider) Key(id string) ([]byte, error) {
+	k, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("storagetests: unknown key id %q", id)
+	}
+	return k, nil
+}
+
+// TestEncryptedStorageConformance runs the full conformance suite against a
+// memory-backed storage wrapped with storage.Encrypted, proving the decorator
+// is a drop-in storage.Interface.
+func TestEncryptedStorageConformance(t *testing.T) {
+	kp := newStaticKeyProvider("k1", bytes.Repeat([]byte("a"), 32))
+	RunStorageTests(t, func() storage.Interface {
+		return storage.Encrypted(storage.NewMemory(), kp)
+	}, nil)
+}
+
+func TestEncryptedStorageHidesPlaintext(t *testing.T) {
+	is := assert.New(t)
+	kp := newStaticKeyProvider("k1", bytes.Repeat([]byte("b"), 32))
+	inner := storage.NewMemory()
+	s := storage.Encrypted(inner, kp)
+	is.NoError(s.Create())
+
+	u := unit.NewTextPlain(unit.OptionTitle("SuperSecretTitle"), unit.OptionTextPlainData("SuperSecretData"))
+	is.NoError(s.SaveUnit(u))
+
+	raw, err := inner.LoadUnit(u.ID())
+	is.NoError(err)
+	is.NotNil(raw)
+
+	rawBytes, err := json.Marshal(raw)
+	is.NoError(err)
+	is.NotContains(string(rawBytes), "SuperSecretTitle")
+	is.NotContains(string(rawBytes), "SuperSecretData")
+
+	lu, err := s.LoadUnit(u.ID())
+	is.NoError(err)
+	is.True(unit.Equal(u, lu))
+}
+
+func TestEncryptedStorageSupportsKeyRotation(t *testing.T) {
+	is := assert.New(t)
+	kp := newStaticKeyProvider("k1", bytes.Repeat([]byte("c"), 32))
+	inner := storage.NewMemory()
+	s := storage.Encrypted(inner, kp)
+	is.NoError(s.Create())
+
+	u := unit.NewTextPlain(unit.OptionTitle("MyUnit"), unit.OptionTextPlainData("MyData"))
+	is.NoError(s.SaveUnit(u))
+
+	kp.keys["k2"] = bytes.Repeat([]byte("d"), 32)
+	kp.activeID = "k2"
+
+	uNew := unit.NewTextPlain(unit.OptionTitle("MyNewUnit"), unit.OptionTextPlainData("MyNewData"))
+	is.NoError(s.SaveUnit(uNew))
+
+	lu, err := s.LoadUnit(u.ID())
+	is.NoError(err)
+	is.True(unit.Equal(u, lu))
+
+	luNew, err := s.LoadUnit(uNew.ID())
+	is.NoError(err)
+	is.True(unit.Equal(uNew, luNew))
+}